@@ -15,154 +15,346 @@
 package abs
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
 	"path"
+	"sync"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
 )
 
 const (
 	v1 = "v1/"
+
+	// defaultBlockSize is the size of each staged block used when BlockSize is left unset. Azure
+	// allows up to 4000 MiB per block; 4 MiB keeps memory use modest while still making a large
+	// multi-GB snapshot upload in a reasonable number of requests.
+	defaultBlockSize = 4 * 1024 * 1024
+
+	// maxBlocks is Azure's limit on the number of blocks a block blob may be committed from,
+	// bounding the maximum blob size this package can write to BlockSize * maxBlocks.
+	maxBlocks = 50000
+
+	// maxConcurrentBlocks bounds how many blocks are staged in parallel per Put.
+	maxConcurrentBlocks = 8
+
+	// maxBlockRetries is the number of attempts made to stage a single block before giving up.
+	maxBlockRetries = 3
+
+	// maxCopyPollAttempts bounds how many times CopyPrefix polls a single blob copy for completion
+	// before giving up on it.
+	maxCopyPollAttempts = 30
+
+	// copyPollInterval is the delay between copy status polls in CopyPrefix.
+	copyPollInterval = 1 * time.Second
 )
 
+// BlockSize is the size, in bytes, of each block staged by Put/PutReader. It defaults to 4 MiB
+// (Azure's block limit is 50000 blocks, so this also bounds the largest blob this package can
+// write to BlockSize * 50000, ~195 GiB at the default). Tests shrink it to exercise the
+// multi-block and CommitBlockList path without uploading multi-megabyte fixtures.
+var BlockSize = defaultBlockSize
+
 // ABS is a helper to wrap complex ABS logic
 type ABS struct {
-	container *storage.Container
+	container *container.Client
 	prefix    string
-	client    *storage.BlobStorageClient
+	client    *service.Client
 }
 
-// New returns a new ABS object for a given container using credentials set in the environment
-func New(container, prefix string) (*ABS, error) {
+// New returns a new ABS object for a given container, resolving credentials entirely from the
+// environment. It is equivalent to NewWithCredential with a zero Credential.
+func New(containerName, prefix string) (*ABS, error) {
+	return NewWithCredential(containerName, prefix, Credential{})
+}
+
+// NewWithCredential returns a new ABS object for a given container, using cred to pick a
+// credential source (see Credential for the fields and their environment-variable fallbacks) and
+// the account name from AZURE_STORAGE_ACCOUNT. A caller can fill cred from a backup CR's
+// azureSecret rather than relying on whatever credential happens to be ambient in the operator
+// process; pkg/backup itself does not call this function.
+func NewWithCredential(containerName, prefix string, cred Credential) (*ABS, error) {
 	accountName := os.Getenv("AZURE_STORAGE_ACCOUNT")
 	if accountName == "" {
 		return nil, fmt.Errorf("missing required environment variable of AZURE_STORAGE_ACCOUNT")
 	}
-	accountKey := os.Getenv("AZURE_STORAGE_KEY")
-	if accountKey == "" {
-		return nil, fmt.Errorf("missing required environment variable of AZURE_STORAGE_KEY")
-	}
-	basicClient, err := storage.NewBasicClient(accountName, accountKey)
+
+	serviceClient, err := newServiceClient(accountName, cred)
 	if err != nil {
-		return nil, fmt.Errorf("Create ABS client failed: %v", err)
+		return nil, fmt.Errorf("create ABS client failed: %v", err)
 	}
 
-	return NewFromClient(container, prefix, &basicClient)
+	return NewFromClient(containerName, prefix, serviceClient)
 }
 
-// NewFromClient returns a new ABS object for a given container using the supplied storageClient
-func NewFromClient(container, prefix string, storageClient *storage.Client) (*ABS, error) {
-	client := storageClient.GetBlobService()
-
+// NewFromClient returns a new ABS object for a given container using the supplied service client
+func NewFromClient(containerName, prefix string, serviceClient *service.Client) (*ABS, error) {
 	return &ABS{
-		container: client.GetContainerReference(container),
+		container: serviceClient.NewContainerClient(containerName),
 		prefix:    prefix,
-		client:    &client,
+		client:    serviceClient,
 	}, nil
 }
 
-// Put puts a chunk of data into a ABS container using the provided key for its reference
-func (w *ABS) Put(key string, chunk []byte) error {
+// Prefix returns the key prefix this ABS was constructed with.
+func (w *ABS) Prefix() string {
+	return w.prefix
+}
+
+// clientOptions returns the azcore client options used by an ABS service client for the given
+// Azure cloud, wiring up the default retry policy so transient network and throttling errors are
+// retried transparently.
+func clientOptions(cfg cloud.Configuration) *service.ClientOptions {
+	return &service.ClientOptions{ClientOptions: azcoreClientOptions(cfg)}
+}
+
+// azcoreClientOptions returns the azcore.ClientOptions (an alias of policy.ClientOptions) used by
+// both the storage service clients and azidentity, so retry behavior and the target cloud stay in
+// sync regardless of which credential source is in play.
+func azcoreClientOptions(cfg cloud.Configuration) policy.ClientOptions {
+	return policy.ClientOptions{
+		Cloud: cfg,
+		Retry: policy.RetryOptions{},
+	}
+}
+
+// Put uploads chunk to a ABS container using the provided key for its reference, staging it as
+// one or more blocks and committing them in order once every block has landed. ctx governs the
+// whole upload, including every staged block and the final commit.
+func (w *ABS) Put(ctx context.Context, key string, chunk []byte) error {
+	return w.PutReader(ctx, key, bytes.NewReader(chunk))
+}
+
+// PutReader streams r into a ABS container using the provided key for its reference. r is split
+// into fixed-size blocks (BlockSize), staged concurrently by a bounded worker pool with retries,
+// and committed with a single PutBlockList call once every block has been staged successfully, so
+// a Put either leaves behind a complete, readable blob or no blob at all. ctx governs the whole
+// upload, including every staged block and the final commit.
+func (w *ABS) PutReader(ctx context.Context, key string, r io.Reader) error {
 	blobName := path.Join(v1, w.prefix, key)
-	blob := w.container.GetBlobReference(blobName)
+	blockBlobClient := w.container.NewBlockBlobClient(blobName)
 
-	opts := &storage.PutBlobOptions{}
-	err := blob.CreateBlockBlob(opts)
+	blockIDs, err := w.stageBlocks(ctx, blockBlobClient, r)
 	if err != nil {
-		return fmt.Errorf("create block blob failed: %v", err)
+		return fmt.Errorf("stage blocks failed: %v", err)
 	}
 
-	blockID := base64.StdEncoding.EncodeToString(randBytes(6))
-	err = blob.PutBlock(blockID, chunk, nil)
-	if err != nil {
-		return fmt.Errorf("put block failed: %v", err)
+	if _, err := blockBlobClient.CommitBlockList(ctx, blockIDs, nil); err != nil {
+		return fmt.Errorf("commit block list failed: %v", err)
+	}
+
+	return nil
+}
+
+// stageBlocks reads r in BlockSize chunks, assigns each chunk a stable, fixed-width block ID (so
+// the returned list is already in upload order), and stages them with up to maxConcurrentBlocks
+// uploads in flight, making up to maxBlockRetries attempts per block on any error. Results
+// are collected behind a mutex rather than a channel so dispatching the Nth block never blocks on
+// a consumer that isn't running yet.
+func (w *ABS) stageBlocks(ctx context.Context, blockBlobClient *blockblob.Client, r io.Reader) ([]string, error) {
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, maxConcurrentBlocks)
+		mu       sync.Mutex
+		firstErr error
+		blocks   []string
+	)
+
+	recordErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
 
+	index := 0
+	for {
+		buf := make([]byte, BlockSize)
+		n, readErr := io.ReadFull(r, buf)
+		if n == 0 {
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil && readErr != io.ErrUnexpectedEOF {
+				wg.Wait()
+				return nil, readErr
+			}
+		}
+		if index >= maxBlocks {
+			wg.Wait()
+			return nil, fmt.Errorf("input exceeds maximum of %d blocks (%d bytes)", maxBlocks, maxBlocks*BlockSize)
+		}
+
+		buf = buf[:n]
+		id := blockID(index)
+		blocks = append(blocks, id)
+		index++
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, buf []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := stageBlockWithRetry(ctx, blockBlobClient, id, buf); err != nil {
+				recordErr(fmt.Errorf("stage block %s failed: %v", id, err))
+			}
+		}(id, buf)
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			wg.Wait()
+			return nil, readErr
+		}
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return blocks, nil
+}
+
+func stageBlockWithRetry(ctx context.Context, blockBlobClient *blockblob.Client, blockID string, buf []byte) error {
+	var err error
+	for attempt := 0; attempt < maxBlockRetries; attempt++ {
+		body := streaming.NopCloser(bytes.NewReader(buf))
+		if _, err = blockBlobClient.StageBlock(ctx, blockID, body, nil); err == nil {
+			return nil
+		}
+	}
 	return err
 }
 
+// blockID renders index as a fixed-width, base64-encoded sequence number. The width is constant
+// across all blocks so the encoded IDs are well-formed regardless of how many blocks are staged;
+// commit order itself comes from appending blocks in read order, not from sorting these IDs.
+func blockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%05d", index)))
+}
+
 // Get gets the blob object specified by key from a ABS container
-func (w *ABS) Get(key string) (io.ReadCloser, error) {
+func (w *ABS) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	blobName := path.Join(v1, w.prefix, key)
-	blob := w.container.GetBlobReference(blobName)
+	blobClient := w.container.NewBlobClient(blobName)
 
-	opts := &storage.GetBlobOptions{}
-	resp, err := blob.Get(opts)
+	resp, err := blobClient.DownloadStream(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return resp, nil
+	return resp.Body, nil
 }
 
 // Delete deletes the blob object specified by key from a ABS container
-func (w *ABS) Delete(key string) error {
+func (w *ABS) Delete(ctx context.Context, key string) error {
 	blobName := path.Join(v1, w.prefix, key)
-	blob := w.container.GetBlobReference(blobName)
-
-	opts := &storage.DeleteBlobOptions{}
-	err := blob.Delete(opts)
+	blobClient := w.container.NewBlobClient(blobName)
 
+	_, err := blobClient.Delete(ctx, nil)
 	return err
 }
 
 // List lists all blobs in a given ABS container
-func (w *ABS) List() ([]string, error) {
-	_, l, err := w.list(w.prefix)
+func (w *ABS) List(ctx context.Context) ([]string, error) {
+	_, l, err := w.list(ctx, w.prefix)
 	return l, err
 }
 
-func (w *ABS) list(prefix string) (int64, []string, error) {
-	params := storage.ListBlobsParameters{Prefix: path.Join(v1, prefix) + "/"}
-	resp, err := w.container.ListBlobs(params)
-	if err != nil {
-		return -1, nil, err
-	}
+func (w *ABS) list(ctx context.Context, prefix string) (int64, []string, error) {
+	listPrefix := path.Join(v1, prefix) + "/"
+	pager := w.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: &listPrefix,
+	})
 
 	keys := []string{}
 	var size int64
-	for _, blob := range resp.Blobs {
-		k := (blob.Name)[len(resp.Prefix):]
-		keys = append(keys, k)
-		size += blob.Properties.ContentLength
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return -1, nil, err
+		}
+		for _, blob := range page.Segment.BlobItems {
+			k := (*blob.Name)[len(listPrefix):]
+			keys = append(keys, k)
+			size += *blob.Properties.ContentLength
+		}
 	}
 
 	return size, keys, nil
 }
 
 // TotalSize returns the total size of all blobs in a ABS container
-func (w *ABS) TotalSize() (int64, error) {
-	size, _, err := w.list(w.prefix)
+func (w *ABS) TotalSize(ctx context.Context) (int64, error) {
+	size, _, err := w.list(ctx, w.prefix)
 	return size, err
 }
 
-// CopyPrefix copies all blobs with given prefix
-func (w *ABS) CopyPrefix(from string) error {
-	_, blobs, err := w.list(from)
+// CopyPrefix copies all blobs with given prefix, waiting for each copy to reach a terminal state
+// before starting the next one.
+func (w *ABS) CopyPrefix(ctx context.Context, from string) error {
+	_, blobs, err := w.list(ctx, from)
 	if err != nil {
 		return err
 	}
-	for _, blob := range blobs {
-		blobResource := w.container.GetBlobReference(blob)
+	for _, name := range blobs {
+		srcBlobClient := w.container.NewBlobClient(path.Join(v1, from, name))
+		dstBlobClient := w.container.NewBlobClient(path.Join(v1, w.prefix, name))
 
-		opts := storage.CopyOptions{}
-		if err = blobResource.Copy(path.Join(w.container.Name, v1, from, blob), &opts); err != nil {
+		resp, err := dstBlobClient.StartCopyFromURL(ctx, srcBlobClient.URL(), nil)
+		if err != nil {
 			return err
 		}
+		if err := waitForCopy(ctx, dstBlobClient, resp.CopyStatus); err != nil {
+			return fmt.Errorf("copy %s failed: %v", name, err)
+		}
 	}
 	return nil
 }
 
-func randBytes(n int) []byte {
-	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// waitForCopy polls blobClient until a copy that StartCopyFromURL reported as status reaches a
+// terminal state, returning an error if it fails, is aborted, or doesn't finish within
+// maxCopyPollAttempts. Same-account copies like the ones CopyPrefix performs complete synchronously
+// in practice, so this almost always returns on the first check, but StartCopyFromURL is documented
+// as asynchronous in general and nothing guarantees that holds for every copy.
+func waitForCopy(ctx context.Context, blobClient *blob.Client, status *blob.CopyStatusType) error {
+	for attempt := 0; ; attempt++ {
+		if status != nil {
+			switch *status {
+			case blob.CopyStatusTypeSuccess:
+				return nil
+			case blob.CopyStatusTypeFailed, blob.CopyStatusTypeAborted:
+				return fmt.Errorf("copy ended with status %q", *status)
+			}
+		}
+		if attempt >= maxCopyPollAttempts {
+			return fmt.Errorf("copy did not reach a terminal status after %d polls", maxCopyPollAttempts)
+		}
 
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+		select {
+		case <-time.After(copyPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		props, err := blobClient.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
 	}
-	return b
 }
@@ -0,0 +1,173 @@
+// Copyright 2017 The etcd-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+)
+
+// Supported values for Credential.CloudName / the backup CRD's azureSecret.cloudName field.
+const (
+	CloudNamePublic     = "AzurePublicCloud"
+	CloudNameChina      = "AzureChinaCloud"
+	CloudNameGovernment = "AzureUSGovernmentCloud"
+)
+
+var serviceURLSuffixes = map[string]string{
+	CloudNamePublic:     "blob.core.windows.net",
+	CloudNameChina:      "blob.core.chinacloudapi.cn",
+	CloudNameGovernment: "blob.core.usgovcloudapi.net",
+}
+
+var cloudConfigurations = map[string]cloud.Configuration{
+	CloudNamePublic:     cloud.AzurePublic,
+	CloudNameChina:      cloud.AzureChina,
+	CloudNameGovernment: cloud.AzureGovernment,
+}
+
+// Credential carries an explicit Azure credential configuration, so a caller such as pkg/backup
+// can populate it from a backup CR's azureSecret instead of every ABS in the process sharing
+// whichever ambient credential happens to be in the operator's environment. Any field left zero
+// falls back to the corresponding AZURE_STORAGE_* environment variable, preserving New's existing
+// env-only behavior for callers that don't pass a Credential.
+type Credential struct {
+	// CloudName selects the storage endpoint suffix and AAD cloud configuration (one of the
+	// CloudName* constants). Falls back to AZURE_CLOUD_NAME, then the public cloud.
+	CloudName string
+	// SASToken, if set, is used as-is as the service URL query string. Falls back to
+	// AZURE_STORAGE_SAS_TOKEN.
+	SASToken string
+	// ConnectionString, if set, is passed to service.NewClientFromConnectionString. Falls back to
+	// AZURE_STORAGE_CONNECTION_STRING.
+	ConnectionString string
+	// AccountKey, if set, is used for shared-key auth. Falls back to AZURE_STORAGE_KEY.
+	AccountKey string
+	// TenantID, ClientID, and ClientSecret, if all set, authenticate as an Azure AD service
+	// principal via azidentity.NewClientSecretCredential. Otherwise they fall back to
+	// AZURE_TENANT_ID, AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET, which azidentity's default
+	// credential chain already reads on its own.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+func (c Credential) cloudName() string {
+	if c.CloudName != "" {
+		return c.CloudName
+	}
+	return os.Getenv("AZURE_CLOUD_NAME")
+}
+
+func (c Credential) sasToken() string {
+	if c.SASToken != "" {
+		return c.SASToken
+	}
+	return os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+}
+
+func (c Credential) connectionString() string {
+	if c.ConnectionString != "" {
+		return c.ConnectionString
+	}
+	return os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+}
+
+func (c Credential) accountKey() string {
+	if c.AccountKey != "" {
+		return c.AccountKey
+	}
+	return os.Getenv("AZURE_STORAGE_KEY")
+}
+
+// servicePrincipal returns the tenant/client ID and secret to use for an explicit Azure AD service
+// principal, and whether all three were supplied (by Credential or environment variables).
+func (c Credential) servicePrincipal() (tenantID, clientID, clientSecret string, ok bool) {
+	tenantID, clientID, clientSecret = c.TenantID, c.ClientID, c.ClientSecret
+	if tenantID == "" {
+		tenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	if clientSecret == "" {
+		clientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+	return tenantID, clientID, clientSecret, tenantID != "" && clientID != "" && clientSecret != ""
+}
+
+// newServiceClient resolves a *service.Client for accountName using the first credential source
+// cred (or, for any field left unset, the environment) provides, in order: a SAS token, a
+// connection string, a shared account key, an explicit Azure AD service principal, and finally
+// azidentity.NewDefaultAzureCredential's own fallback chain (workload identity, managed identity,
+// an env-based service principal, or the az CLI).
+func newServiceClient(accountName string, cred Credential) (*service.Client, error) {
+	cfg, suffix, err := cloudSettings(cred.cloudName())
+	if err != nil {
+		return nil, err
+	}
+	serviceURL := fmt.Sprintf("https://%s.%s/", accountName, suffix)
+	opts := clientOptions(cfg)
+
+	if sasToken := cred.sasToken(); sasToken != "" {
+		return service.NewClientWithNoCredential(serviceURL+"?"+sasToken, opts)
+	}
+
+	if connStr := cred.connectionString(); connStr != "" {
+		return service.NewClientFromConnectionString(connStr, opts)
+	}
+
+	if accountKey := cred.accountKey(); accountKey != "" {
+		sharedKeyCred, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("create ABS shared key credential failed: %v", err)
+		}
+		return service.NewClientWithSharedKeyCredential(serviceURL, sharedKeyCred, opts)
+	}
+
+	if tenantID, clientID, clientSecret, ok := cred.servicePrincipal(); ok {
+		spCred, err := azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, &azidentity.ClientSecretCredentialOptions{
+			ClientOptions: azcoreClientOptions(cfg),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create ABS service principal credential failed: %v", err)
+		}
+		return service.NewClient(serviceURL, spCred, opts)
+	}
+
+	defaultCred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+		ClientOptions: azcoreClientOptions(cfg),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create ABS Azure AD credential failed: %v", err)
+	}
+	return service.NewClient(serviceURL, defaultCred, opts)
+}
+
+func cloudSettings(cloudName string) (cloud.Configuration, string, error) {
+	if cloudName == "" {
+		cloudName = CloudNamePublic
+	}
+	cfg, ok := cloudConfigurations[cloudName]
+	if !ok {
+		return cloud.Configuration{}, "", fmt.Errorf("unsupported Azure cloud name %q", cloudName)
+	}
+	return cfg, serviceURLSuffixes[cloudName], nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 The etcd-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package abs
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+func TestCloudSettings(t *testing.T) {
+	cases := []struct {
+		name       string
+		cloudName  string
+		wantSuffix string
+		wantCfg    cloud.Configuration
+		wantErr    bool
+	}{
+		{name: "empty defaults to public", cloudName: "", wantSuffix: serviceURLSuffixes[CloudNamePublic], wantCfg: cloud.AzurePublic},
+		{name: "public", cloudName: CloudNamePublic, wantSuffix: "blob.core.windows.net", wantCfg: cloud.AzurePublic},
+		{name: "china", cloudName: CloudNameChina, wantSuffix: "blob.core.chinacloudapi.cn", wantCfg: cloud.AzureChina},
+		{name: "government", cloudName: CloudNameGovernment, wantSuffix: "blob.core.usgovcloudapi.net", wantCfg: cloud.AzureGovernment},
+		{name: "unknown cloud name errors", cloudName: "NotACloud", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, suffix, err := cloudSettings(c.cloudName)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("cloudSettings(%q): want error, got nil", c.cloudName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cloudSettings(%q): %v", c.cloudName, err)
+			}
+			if suffix != c.wantSuffix {
+				t.Errorf("suffix = %q, want %q", suffix, c.wantSuffix)
+			}
+			if cfg != c.wantCfg {
+				t.Errorf("cfg = %+v, want %+v", cfg, c.wantCfg)
+			}
+		})
+	}
+}
+
+// TestNewServiceClientPrecedence checks that newServiceClient honors the documented
+// SAS > connection string > shared key > service principal > DefaultAzureCredential order. Each
+// case gives a valid value for the source under test alongside deliberately malformed values for
+// every lower-priority source, so the case only passes if newServiceClient picked the source it's
+// supposed to rather than falling through to (and failing on) one of the others.
+func TestNewServiceClientPrecedence(t *testing.T) {
+	const account = "testaccount"
+	// validAccountKey is valid base64, but not a real Azure storage key; only its encoding matters
+	// to NewSharedKeyCredential, which never makes a network call.
+	const validAccountKey = "ZmFrZWZha2VmYWtlZmFrZWZha2VmYWtlZmFrZWZha2U="
+	// invalidAccountKey is not valid base64, so NewSharedKeyCredential rejects it outright.
+	const invalidAccountKey = "not-valid-base64!!"
+	// invalidTenantID isn't a well-formed tenant ID (it contains spaces), so
+	// NewClientSecretCredential rejects it without a network call.
+	const invalidTenantID = "not a tenant id"
+
+	cases := []struct {
+		name string
+		cred Credential
+	}{
+		{
+			name: "SAS token takes precedence over everything else",
+			cred: Credential{
+				SASToken:         "sv=2020-01-01&sig=abc",
+				ConnectionString: "not a real connection string",
+				AccountKey:       invalidAccountKey,
+				TenantID:         invalidTenantID,
+				ClientID:         "client",
+				ClientSecret:     "secret",
+			},
+		},
+		{
+			name: "connection string takes precedence over shared key and service principal",
+			cred: Credential{
+				ConnectionString: "DefaultEndpointsProtocol=https;AccountName=" + account + ";AccountKey=" + validAccountKey + ";EndpointSuffix=core.windows.net",
+				AccountKey:       invalidAccountKey,
+				TenantID:         invalidTenantID,
+				ClientID:         "client",
+				ClientSecret:     "secret",
+			},
+		},
+		{
+			name: "shared key takes precedence over service principal",
+			cred: Credential{
+				AccountKey:   validAccountKey,
+				TenantID:     invalidTenantID,
+				ClientID:     "client",
+				ClientSecret: "secret",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := newServiceClient(account, c.cred); err != nil {
+				t.Fatalf("newServiceClient: %v", err)
+			}
+		})
+	}
+
+	t.Run("malformed service principal is rejected rather than silently falling back to DefaultAzureCredential", func(t *testing.T) {
+		cred := Credential{
+			TenantID:     invalidTenantID,
+			ClientID:     "client",
+			ClientSecret: "secret",
+		}
+		if _, err := newServiceClient(account, cred); err == nil {
+			t.Fatal("newServiceClient: want error for malformed tenant ID, got nil")
+		}
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 The etcd-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"github.com/google/uuid"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const azuriteBlobPort = "10000/tcp"
+
+// azuriteEndpoint is the blob endpoint tests should talk to, populated by TestMain either from
+// AZURITE_BLOB_ENDPOINT or from a freshly started Azurite container.
+var azuriteEndpoint string
+
+// TestMain starts a shared Azurite container for the package's integration tests when
+// RUN_INTEGRATION_TEST=true and neither an emulator endpoint nor a real storage account is already
+// configured in the environment.
+func TestMain(m *testing.M) {
+	os.Exit(runIntegrationTests(m))
+}
+
+func runIntegrationTests(m *testing.M) int {
+	if os.Getenv("AZURITE_BLOB_ENDPOINT") != "" || os.Getenv("AZURE_STORAGE_ACCOUNT") != "" {
+		azuriteEndpoint = os.Getenv("AZURITE_BLOB_ENDPOINT")
+		return m.Run()
+	}
+
+	if os.Getenv("RUN_INTEGRATION_TEST") != "true" {
+		// No emulator endpoint, no real account, and integration tests weren't requested: let
+		// the individual tests skip themselves with an explanatory message.
+		return m.Run()
+	}
+
+	ctx := context.Background()
+	container, endpoint, err := startAzurite(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start azurite: %v\n", err)
+		return 1
+	}
+	defer container.Terminate(ctx)
+
+	azuriteEndpoint = endpoint
+	return m.Run()
+}
+
+func startAzurite(ctx context.Context) (testcontainers.Container, string, error) {
+	req := testcontainers.ContainerRequest{
+		Image:        "mcr.microsoft.com/azure-storage/azurite:latest",
+		ExposedPorts: []string{azuriteBlobPort},
+		Cmd:          []string{"azurite-blob", "--blobHost", "0.0.0.0"},
+		WaitingFor:   wait.ForListeningPort(azuriteBlobPort),
+	}
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	host, err := c.Host(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := c.MappedPort(ctx, azuriteBlobPort)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return c, fmt.Sprintf("http://%s:%s", host, port.Port()), nil
+}
+
+// newTestServiceClient returns a service client against a real storage account when
+// AZURE_STORAGE_ACCOUNT/AZURE_STORAGE_KEY are set, the running Azurite container otherwise, and
+// skips the test when neither is available.
+func newTestServiceClient(t *testing.T) *service.Client {
+	t.Helper()
+
+	if accountName := os.Getenv("AZURE_STORAGE_ACCOUNT"); accountName != "" {
+		cred, err := azblob.NewSharedKeyCredential(accountName, os.Getenv("AZURE_STORAGE_KEY"))
+		if err != nil {
+			t.Fatalf("create shared key credential: %v", err)
+		}
+		client, err := service.NewClientWithSharedKeyCredential(
+			fmt.Sprintf("https://%s.blob.core.windows.net/", accountName), cred, nil)
+		if err != nil {
+			t.Fatalf("create service client: %v", err)
+		}
+		return client
+	}
+
+	if azuriteEndpoint == "" {
+		t.Skip("skipping integration test: set AZURITE_BLOB_ENDPOINT, AZURE_STORAGE_ACCOUNT, or RUN_INTEGRATION_TEST=true")
+	}
+
+	cred, err := azblob.NewSharedKeyCredential(azblob.StorageEmulatorAccountName, azblob.StorageEmulatorAccountKey)
+	if err != nil {
+		t.Fatalf("create emulator credential: %v", err)
+	}
+	client, err := service.NewClientWithSharedKeyCredential(
+		fmt.Sprintf("%s/%s", azuriteEndpoint, azblob.StorageEmulatorAccountName), cred, nil)
+	if err != nil {
+		t.Fatalf("create service client: %v", err)
+	}
+	return client
+}
+
+// newTestContainer creates a uniquely named container for a test and registers a cleanup that
+// deletes it, so tests exercising the same package-level emulator can still run in parallel.
+func newTestContainer(t *testing.T, client *service.Client) string {
+	t.Helper()
+	ctx := context.Background()
+
+	name := fmt.Sprintf("test-%s", uuid.NewString())
+	containerClient := client.NewContainerClient(name)
+	if _, err := containerClient.Create(ctx, nil); err != nil {
+		t.Fatalf("create container %s: %v", name, err)
+	}
+
+	t.Cleanup(func() {
+		if _, err := containerClient.Delete(context.Background(), nil); err != nil {
+			t.Logf("cleanup: delete container %s: %v", name, err)
+		}
+	})
+
+	return name
+}
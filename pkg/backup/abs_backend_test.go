@@ -16,150 +16,249 @@ package backup
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
-	"os"
-	"reflect"
 	"testing"
 
-	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/coreos/etcd-operator/pkg/backup/abs"
 )
 
-var (
-	accountName    = storage.StorageEmulatorAccountName
-	accountKey     = storage.StorageEmulatorAccountKey
-	DefaultBaseURL = "http://127.0.0.1:10000"
-	container      = "testcontainer"
-	prefix         = "testprefix"
-)
+const testPrefix = "testprefix"
+
+// newTestABSBackend wires up an absBackend against a freshly created, uniquely named container so
+// tests can run in parallel without clobbering each other's blobs.
+func newTestABSBackend(t *testing.T) *absBackend {
+	t.Helper()
+	client := newTestServiceClient(t)
+	container := newTestContainer(t, client)
 
-// TODO: setup and cleanup blocks
+	a, err := abs.NewFromClient(container, testPrefix, client)
+	if err != nil {
+		t.Fatalf("create ABS: %v", err)
+	}
+	return &absBackend{ABS: a}
+}
 
 func TestABSBackendContainerDoesNotExist(t *testing.T) {
-	t.Fatal()
+	client := newTestServiceClient(t)
+
+	a, err := abs.NewFromClient("etcd-operator-test-missing-container", testPrefix, client)
+	if err != nil {
+		t.Fatalf("create ABS: %v", err)
+	}
+	ab := &absBackend{ABS: a}
+
+	if _, err := ab.save("3.1.0", 1, bytes.NewReader([]byte("ignore"))); err == nil {
+		t.Fatal("save against a missing container should have failed, got nil error")
+	}
 }
+
 func TestABSBackendGetLatest(t *testing.T) {
-	if os.Getenv("RUN_INTEGRATION_TEST") != "true" {
-		t.Skip("skipping integration test due to RUN_INTEGRATION_TEST not set")
+	ab := newTestABSBackend(t)
+
+	if _, err := ab.save("3.1.0", 1, bytes.NewReader([]byte("ignore"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ab.save("3.1.1", 2, bytes.NewReader([]byte("ignore"))); err != nil {
+		t.Fatal(err)
 	}
 
-	storageClient, err := storage.NewClient(accountName, accountKey, DefaultBaseURL, "", false)
+	name, err := ab.getLatest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	blobServiceClient := storageClient.GetBlobService()
 
-	// Create container
-	cnt := blobServiceClient.GetContainerReference(container)
-	options := storage.CreateContainerOptions{
-		Access: storage.ContainerAccessTypePrivate,
+	expected := makeBackupName("3.1.1", 2)
+	if name != expected {
+		t.Fatalf("latest name = %s, want %s", name, expected)
 	}
-	_, err = cnt.CreateIfNotExists(&options)
+
+	rc, err := ab.open(name)
 	if err != nil {
-		if accountName == storage.StorageEmulatorAccountName {
-			t.Fatal(err, "Create container failed: If you are running with the emulator credentials, plaase make sure you have started the azurite storage emulator.")
-		}
-		t.Fatal(err, "Create container failed")
+		t.Fatal(err)
 	}
+	defer rc.Close()
 
-	abs, err := abs.NewFromClient(container, prefix, &storageClient)
+	b, err := ioutil.ReadAll(rc)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ab := &absBackend{ABS: abs}
+	if string(b) != "ignore" {
+		t.Errorf("content = %s, want %s", string(b), "ignore")
+	}
+}
+
+func TestABSBackendPurge(t *testing.T) {
+	ab := newTestABSBackend(t)
 
-	if _, err := ab.save("3.1.0", 1, bytes.Neabuffer([]byte("ignore"))); err != nil {
+	if _, err := ab.save("3.1.0", 1, bytes.NewReader([]byte("ignore"))); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := ab.save("3.1.1", 2, bytes.Neabuffer([]byte("ignore"))); err != nil {
+	if _, err := ab.save("3.1.0", 2, bytes.NewReader([]byte("ignore"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ab.purge(1); err != nil {
 		t.Fatal(err)
 	}
 
-	name, err := ab.getLatest()
+	names, err := ab.ABS.List(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := []string{makeBackupName("3.1.0", 2)}
+	if !equalStringSlices(names, want) {
+		t.Errorf("left files after purge, want=%v, got=%v", want, names)
+	}
+}
 
-	rc, err := ab.open(name)
+// TestABSPutMultiBlock shrinks abs.BlockSize so a small payload still spans several blocks,
+// exercising the staged-block + CommitBlockList path added to fix Put.
+func TestABSPutMultiBlock(t *testing.T) {
+	ctx := context.Background()
+	client := newTestServiceClient(t)
+	container := newTestContainer(t, client)
+
+	a, err := abs.NewFromClient(container, testPrefix, client)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expected := makeBackupName("3.1.1", 2)
-	if name != expected {
-		t.Errorf("lastest name = %s, want %s", name, expected)
+	orig := abs.BlockSize
+	abs.BlockSize = 4
+	defer func() { abs.BlockSize = orig }()
+
+	data := []byte("0123456789abcdef") // 16 bytes => 4 blocks at BlockSize=4
+	if err := a.Put(ctx, "multiblock", data); err != nil {
+		t.Fatalf("put: %v", err)
 	}
 
-	b, err := ioutil.ReadAll(rc)
+	rc, err := a.Get(ctx, "multiblock")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("get: %v", err)
 	}
 	defer rc.Close()
 
-	if string(b) != expected {
-		t.Errorf("content = %s, want %s", string(b), expected)
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content = %q, want %q", got, data)
 	}
 
-	// Delete container
-	opts := storage.DeleteContainerOptions{}
-	if err := cnt.Delete(&opts); err != nil {
-		t.Fatal(err)
+	if err := a.Delete(ctx, "multiblock"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := a.Get(ctx, "multiblock"); err == nil {
+		t.Fatal("get after delete should have failed, got nil error")
 	}
 }
 
-func TestABSBackendPurge(t *testing.T) {
-	if os.Getenv("RUN_INTEGRATION_TEST") != "true" {
-		t.Skip("skipping integration test due to RUN_INTEGRATION_TEST not set")
+func TestABSCopyPrefixAndTotalSize(t *testing.T) {
+	ctx := context.Background()
+	client := newTestServiceClient(t)
+	container := newTestContainer(t, client)
+
+	src, err := abs.NewFromClient(container, "src", client)
+	if err != nil {
+		t.Fatal(err)
 	}
-	storageClient, err := storage.NewClient(accountName, accountKey, DefaultBaseURL, "", false)
+	dst, err := abs.NewFromClient(container, "dst", client)
 	if err != nil {
 		t.Fatal(err)
 	}
-	blobServiceClient := storageClient.GetBlobService()
 
-	// Create container
-	cnt := blobServiceClient.GetContainerReference(container)
-	options := storage.CreateContainerOptions{
-		Access: storage.ContainerAccessTypePrivate,
+	want := map[string]string{"a": "aaa", "b": "bb"}
+	for k, v := range want {
+		if err := src.Put(ctx, k, []byte(v)); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
 	}
-	_, err = cnt.CreateIfNotExists(&options)
-	if err != nil {
-		if accountName == storage.StorageEmulatorAccountName {
-			t.Fatal(err, "Create container failed: If you are running with the emulator credentials, plaase make sure you have started the azurite storage emulator.")
+
+	// CopyPrefix is called on the destination ABS and names the source prefix, since an ABS only
+	// knows how to copy into the prefix it was constructed with.
+	if err := dst.CopyPrefix(ctx, "src"); err != nil {
+		t.Fatalf("copy prefix: %v", err)
+	}
+
+	for k, v := range want {
+		rc, err := dst.Get(ctx, k)
+		if err != nil {
+			t.Fatalf("get %s from dst: %v", k, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %s from dst: %v", k, err)
+		}
+		if string(got) != v {
+			t.Errorf("dst content for %s = %q, want %q", k, got, v)
 		}
-		t.Fatal(err, "Create container failed")
 	}
 
-	abs, err := abs.NewFromClient(container, prefix, &storageClient)
+	size, err := dst.TotalSize(ctx)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("total size: %v", err)
 	}
-	ab := &absBackend{ABS: abs}
 
-	if _, err := ab.save("3.1.0", 1, bytes.Neabuffer([]byte("ignore"))); err != nil {
-		t.Fatal(err)
+	var wantSize int64
+	for _, v := range want {
+		wantSize += int64(len(v))
 	}
-	if _, err := ab.save("3.1.0", 2, bytes.Neabuffer([]byte("ignore"))); err != nil {
-		t.Fatal(err)
+	if size != wantSize {
+		t.Errorf("total size = %d, want %d", size, wantSize)
 	}
-	if err := ab.purge(1); err != nil {
-		t.Fatal(err)
+}
+
+// TestABSListPagination writes more blobs than fit on a single List page (Azure's flat listing
+// caps a page at 5000 results) and checks every blob still comes back.
+func TestABSListPagination(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping pagination test in -short mode")
 	}
-	names, err := abs.List()
+
+	ctx := context.Background()
+	client := newTestServiceClient(t)
+	container := newTestContainer(t, client)
+
+	a, err := abs.NewFromClient(container, testPrefix, client)
 	if err != nil {
 		t.Fatal(err)
 	}
-	leftFiles := []string{makeBackupName("3.1.0", 2)}
-	if !reflect.DeepEqual(leftFiles, names) {
-		t.Errorf("left files after purge, want=%v, get=%v", leftFiles, names)
+
+	const count = 5001
+	want := make(map[string]bool, count)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("obj-%05d", i)
+		if err := a.Put(ctx, key, []byte("x")); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		want[key] = true
 	}
-	if err := abs.Delete(makeBackupName("3.1.0", 2)); err != nil {
+
+	got, err := a.List(ctx)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if len(got) != len(want) {
+		t.Fatalf("listed %d blobs, want %d", len(got), len(want))
+	}
+	for _, k := range got {
+		if !want[k] {
+			t.Errorf("unexpected blob %s in listing", k)
+		}
+	}
+}
 
-	// Delete container
-	opts := storage.DeleteContainerOptions{}
-	if err := cnt.Delete(&opts); err != nil {
-		t.Fatal(err)
+func equalStringSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
 }
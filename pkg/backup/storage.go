@@ -0,0 +1,112 @@
+// Copyright 2017 The etcd-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/coreos/etcd-operator/pkg/backup/abs"
+)
+
+// ObjectInfo describes a single object returned by BackupStorage.List.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// BackupStorage is the set of storage operations a backup backend must provide, so the retry and
+// observability behavior in withRetryAndMetrics can wrap any backend the same way. absStorage
+// (built by newABSStorage) is the only implementation in this package.
+type BackupStorage interface {
+	// Put uploads the contents of r under key and returns the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get returns a reader for the object stored under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key has the given prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// CopyPrefix copies every object under the from prefix to the same relative path under to.
+	CopyPrefix(ctx context.Context, from, to string) error
+}
+
+// absStorage adapts *abs.ABS, whose List returns plain key strings and whose CopyPrefix copies only
+// into its own prefix, to the BackupStorage interface.
+type absStorage struct {
+	abs *abs.ABS
+}
+
+// newABSStorage wraps a, backed by middleware providing retries, metrics, and logging, as a
+// BackupStorage.
+func newABSStorage(a *abs.ABS) BackupStorage {
+	return withRetryAndMetrics("abs", &absStorage{abs: a})
+}
+
+func (s *absStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	if err := s.abs.PutReader(ctx, key, cr); err != nil {
+		return 0, err
+	}
+	return cr.n, nil
+}
+
+func (s *absStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.abs.Get(ctx, key)
+}
+
+func (s *absStorage) Delete(ctx context.Context, key string) error {
+	return s.abs.Delete(ctx, key)
+}
+
+func (s *absStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	keys, err := s.abs.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ObjectInfo, 0, len(keys))
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			infos = append(infos, ObjectInfo{Key: k})
+		}
+	}
+	return infos, nil
+}
+
+// CopyPrefix copies every object under from to to. abs.ABS.CopyPrefix only knows how to copy into
+// the prefix it was constructed with, so to must equal that prefix.
+func (s *absStorage) CopyPrefix(ctx context.Context, from, to string) error {
+	if to != s.abs.Prefix() {
+		return fmt.Errorf("abs backend can only copy into its own prefix %q, got %q", s.abs.Prefix(), to)
+	}
+	return s.abs.CopyPrefix(ctx, from)
+}
+
+// countingReader wraps an io.Reader, counting the bytes read from it so absStorage.Put can report
+// how much was written without buffering the whole payload itself: retryingStorage already holds
+// the one replayable copy retries need, and PutReader streams straight from that copy instead of
+// materializing a second one.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 The etcd-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/coreos/pkg/capnslog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var plog = capnslog.NewPackageLogger("github.com/coreos/etcd-operator", "backup")
+
+const (
+	maxStorageRetries = 5
+	baseRetryBackoff  = 100 * time.Millisecond
+	maxRetryBackoff   = 5 * time.Second
+)
+
+var (
+	storageBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd_operator",
+		Subsystem: "backup_storage",
+		Name:      "bytes_total",
+		Help:      "Total number of bytes transferred per backend and operation.",
+	}, []string{"backend", "op"})
+
+	storageOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "etcd_operator",
+		Subsystem: "backup_storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of backup storage operations, by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "op"})
+
+	storageErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd_operator",
+		Subsystem: "backup_storage",
+		Name:      "errors_total",
+		Help:      "Total number of failed backup storage operations, by backend and operation.",
+	}, []string{"backend", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(storageBytesTotal, storageOpDuration, storageErrorsTotal)
+}
+
+// retryingStorage wraps a BackupStorage with context-aware retries, Prometheus metrics, and
+// structured logging, so every backend (ABS today; S3 and GCS once they adopt BackupStorage) gets
+// the same retry and observability behavior without implementing it itself.
+type retryingStorage struct {
+	backend string
+	next    BackupStorage
+}
+
+// withRetryAndMetrics wraps next with the shared retry/metrics/logging middleware, tagging its
+// metrics and log lines with backend (e.g. "abs").
+func withRetryAndMetrics(backend string, next BackupStorage) BackupStorage {
+	return &retryingStorage{backend: backend, next: next}
+}
+
+func (s *retryingStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	// A retried attempt needs to re-read from the start of the payload, so buffer it once here
+	// rather than asking every backend to make r seekable.
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = s.do(ctx, "put", func(ctx context.Context) error {
+		var putErr error
+		n, putErr = s.next.Put(ctx, key, bytes.NewReader(b))
+		return putErr
+	})
+	if err == nil {
+		storageBytesTotal.WithLabelValues(s.backend, "put").Add(float64(n))
+	}
+	return n, err
+}
+
+func (s *retryingStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := s.do(ctx, "get", func(ctx context.Context) error {
+		var getErr error
+		rc, getErr = s.next.Get(ctx, key)
+		return getErr
+	})
+	return rc, err
+}
+
+func (s *retryingStorage) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, "delete", func(ctx context.Context) error {
+		return s.next.Delete(ctx, key)
+	})
+}
+
+func (s *retryingStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	err := s.do(ctx, "list", func(ctx context.Context) error {
+		var listErr error
+		infos, listErr = s.next.List(ctx, prefix)
+		return listErr
+	})
+	return infos, err
+}
+
+func (s *retryingStorage) CopyPrefix(ctx context.Context, from, to string) error {
+	return s.do(ctx, "copy_prefix", func(ctx context.Context) error {
+		return s.next.CopyPrefix(ctx, from, to)
+	})
+}
+
+// do runs fn, making up to maxStorageRetries attempts with exponential backoff and jitter between
+// attempts as long as fn's error is classified as transient by isRetryable and ctx hasn't expired.
+// It always records op's latency, and increments the error counter if every attempt failed.
+func (s *retryingStorage) do(ctx context.Context, op string, fn func(context.Context) error) error {
+	start := time.Now()
+
+	var err error
+	for attempt := 0; attempt < maxStorageRetries; attempt++ {
+		if err = fn(ctx); err == nil {
+			break
+		}
+		if !isRetryable(err) {
+			break
+		}
+
+		plog.Warningf("backup storage %s %s failed (attempt %d/%d): %v", s.backend, op, attempt+1, maxStorageRetries, err)
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+	}
+
+	storageOpDuration.WithLabelValues(s.backend, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrorsTotal.WithLabelValues(s.backend, op).Inc()
+		plog.Errorf("backup storage %s %s failed: %v", s.backend, op, err)
+	}
+	return err
+}
+
+// Azure blob error codes worth retrying versus errors that will never succeed on retry. Anything
+// not in either list is treated as retryable too, since S3 and GCS don't expose a typed error
+// taxonomy here and a conservative default is safer than giving up on an unrecognized error.
+var (
+	retryableBlobCodes = []bloberror.Code{
+		bloberror.ServerBusy,
+		bloberror.OperationTimedOut,
+		bloberror.InternalError,
+	}
+
+	permanentBlobCodes = []bloberror.Code{
+		bloberror.ContainerNotFound,
+		bloberror.BlobNotFound,
+		bloberror.AuthenticationFailed,
+		bloberror.AuthorizationFailure,
+		bloberror.InvalidAuthenticationInfo,
+	}
+)
+
+func isRetryable(err error) bool {
+	for _, code := range retryableBlobCodes {
+		if bloberror.HasCode(err, code) {
+			return true
+		}
+	}
+	for _, code := range permanentBlobCodes {
+		if bloberror.HasCode(err, code) {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff returns an exponential backoff duration for the given zero-based attempt, capped at
+// maxRetryBackoff and jittered by up to 50% so concurrent backups retrying the same failure don't
+// all hammer the backend in lockstep.
+func backoff(attempt int) time.Duration {
+	d := baseRetryBackoff * time.Duration(math.Pow(2, float64(attempt)))
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}